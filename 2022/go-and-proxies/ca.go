@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"os"
+	"runtime"
+	"time"
+)
+
+// caValidityPeriod is how long a freshly-generated root CA is valid for.
+const caValidityPeriod = 10 * 365 * 24 * time.Hour
+
+// generateCA creates a new P-256 root CA, writes it to certFile/keyFile as
+// PEM (mode 0600), and returns the parsed certificate and key so the
+// caller can start using it immediately without a re-read.
+func generateCA(certFile, keyFile string) (*x509.Certificate, any, error) {
+	log.Println("generating root CA at", certFile, "/", keyFile)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spkiDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	subjectKeyId := sha1.Sum(spkiDER)
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"My Corp"},
+			CommonName:   "My Corp MITM Root CA",
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(caValidityPeriod),
+
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          subjectKeyId[:],
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	privBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
+
+	if err := os.WriteFile(certFile, pemCert, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(keyFile, pemKey, 0600); err != nil {
+		return nil, nil, err
+	}
+	// os.WriteFile only applies the mode when it creates the file, so force
+	// it for files that already existed.
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chmod(f, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	printTrustInstructions(certFile)
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, privateKey, nil
+}
+
+// printTrustInstructions tells the operator how to get the newly-generated
+// CA trusted locally, since traffic through the proxy will otherwise show
+// up as certificate errors in every client.
+func printTrustInstructions(certFile string) {
+	log.Println("root CA written to", certFile)
+	log.Println("to trust it:")
+	switch runtime.GOOS {
+	case "darwin":
+		log.Printf("  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", certFile)
+	case "windows":
+		log.Printf("  certutil -addstore -f \"ROOT\" %s\n", certFile)
+	default:
+		log.Printf("  sudo cp %s /usr/local/share/ca-certificates/mitm-proxy-ca.crt && sudo update-ca-certificates\n", certFile)
+	}
+}
+
+// fileExists is a small helper so createForwardProxy can decide whether to
+// bootstrap a CA or load an existing one.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultCertMargin is how long before a cached leaf's NotAfter it is
+// considered expired and re-minted.
+const defaultCertMargin = time.Hour
+
+// certCache holds freshly-minted leaf certificates keyed by the SNI
+// hostname they cover, so proxyConnect doesn't have to sign a new ECDSA key
+// on every CONNECT. Entries are evicted once they fall within margin of
+// their NotAfter.
+type certCache struct {
+	mu      sync.RWMutex
+	entries map[string]*tls.Certificate
+
+	margin time.Duration
+	group  singleflight.Group
+}
+
+func newCertCache(margin time.Duration) *certCache {
+	if margin <= 0 {
+		margin = defaultCertMargin
+	}
+	return &certCache{
+		entries: make(map[string]*tls.Certificate),
+		margin:  margin,
+	}
+}
+
+// get returns a cached, still-valid certificate for host, if any.
+func (c *certCache) get(host string) (*tls.Certificate, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cert, ok := c.entries[host]
+	if !ok || c.expired(cert) {
+		return nil, false
+	}
+	return cert, true
+}
+
+func (c *certCache) expired(cert *tls.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return true
+		}
+	}
+	return time.Now().Add(c.margin).After(leaf.NotAfter)
+}
+
+func (c *certCache) put(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = cert
+}
+
+// getOrCreate returns the cached certificate for host, minting and storing
+// one via mint if there's no valid entry. Concurrent misses for the same
+// host are coalesced behind a singleflight group so only one signs the leaf.
+func (c *certCache) getOrCreate(host string, mint func(host string) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert, ok := c.get(host); ok {
+		return cert, nil
+	}
+
+	v, err, _ := c.group.Do(host, func() (interface{}, error) {
+		if cert, ok := c.get(host); ok {
+			return cert, nil
+		}
+		log.Println("minting certificate for", host)
+		cert, err := mint(host)
+		if err != nil {
+			return nil, err
+		}
+		c.put(host, cert)
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -10,14 +12,20 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+
+	"example.com/go-and-proxies/internal/flowstore"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
 )
 
 // TODO: comments
@@ -47,17 +55,22 @@ func (l *singleConnListener) Close() error {
 	return nil
 }
 
-func createCert(dnsNames []string, parent *x509.Certificate, parentKey crypto.PrivateKey, hoursValid int) (cert []byte, priv []byte) {
+// createCert signs a fresh leaf certificate for dnsNames off parent/parentKey.
+// It returns an error rather than fataling because it runs from the TLS
+// GetCertificate callback (through certCache) whenever a handshake's SNI
+// hostname has no valid cached certificate - a single minting failure must
+// fail that one connection, not take down the whole proxy process.
+func createCert(dnsNames []string, parent *x509.Certificate, parentKey crypto.PrivateKey, hoursValid int) (cert []byte, priv []byte, err error) {
 	log.Println("creating cert for domains:", dnsNames)
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatalf("Failed to generate private key: %v", err)
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("Failed to generate serial number: %v", err)
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
 
 	template := x509.Certificate{
@@ -72,27 +85,28 @@ func createCert(dnsNames []string, parent *x509.Certificate, parentKey crypto.Pr
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		AuthorityKeyId:        parent.SubjectKeyId,
 	}
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, &privateKey.PublicKey, parentKey)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %v", err)
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	if pemCert == nil {
-		log.Fatal("failed to encode certificate to PEM")
+		return nil, nil, fmt.Errorf("failed to encode certificate to PEM")
 	}
 
 	privBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
 	if err != nil {
-		log.Fatalf("Unable to marshal private key: %v", err)
+		return nil, nil, fmt.Errorf("unable to marshal private key: %w", err)
 	}
 	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
-	if pemCert == nil {
-		log.Fatal("failed to encode key to PEM")
+	if pemKey == nil {
+		return nil, nil, fmt.Errorf("failed to encode key to PEM")
 	}
 
-	return pemCert, pemKey
+	return pemCert, pemKey, nil
 }
 
 func loadX509KeyPair(certFile, keyFile string) (cert *x509.Certificate, key any, err error) {
@@ -123,19 +137,60 @@ func loadX509KeyPair(certFile, keyFile string) (cert *x509.Certificate, key any,
 type forwardProxy struct {
 	caCert *x509.Certificate
 	caKey  any
+
+	// transport is reused across CONNECT tunnels so TLS connections to each
+	// origin host are pooled rather than re-dialed per request.
+	transport   *http.Transport
+	h2Transport *http2.Transport
+	logger      RequestLogger
+	certCache   *certCache
+	policy      Policy
+	flows       *flowstore.FlowStore
 }
 
-func createForwardProxy(caCertFile, caKeyFile string) *forwardProxy {
-	caCert, caKey, err := loadX509KeyPair(caCertFile, caKeyFile)
-	if err != nil {
-		log.Fatal("Error loading CA certificate/key:", err)
+func createForwardProxy(caCertFile, caKeyFile string, generate bool) *forwardProxy {
+	var caCert *x509.Certificate
+	var caKey any
+	var err error
+
+	if generate || !fileExists(caCertFile) || !fileExists(caKeyFile) {
+		caCert, caKey, err = generateCA(caCertFile, caKeyFile)
+		if err != nil {
+			log.Fatal("Error generating CA certificate/key:", err)
+		}
+	} else {
+		caCert, caKey, err = loadX509KeyPair(caCertFile, caKeyFile)
+		if err != nil {
+			log.Fatal("Error loading CA certificate/key:", err)
+		}
 	}
 	log.Printf("loaded CA certificate and key; IsCA=%v\n", caCert.IsCA)
 
+	flows := flowstore.New()
 	return &forwardProxy{
-		caCert: caCert,
-		caKey:  caKey,
+		caCert:      caCert,
+		caKey:       caKey,
+		transport:   &http.Transport{},
+		h2Transport: &http2.Transport{},
+		logger:      multiLogger{dumpLogger{}, storeLogger{store: flows}},
+		certCache:   newCertCache(defaultCertMargin),
+		policy:      newDefaultPolicy(),
+		flows:       flows,
+	}
+}
+
+// mintCert signs a fresh leaf certificate for host off the proxy's CA. It's
+// the slow path behind certCache.getOrCreate.
+func (p *forwardProxy) mintCert(host string) (*tls.Certificate, error) {
+	pemCert, pemKey, err := createCert([]string{host}, p.caCert, p.caKey, 240)
+	if err != nil {
+		return nil, err
 	}
+	cert, err := tls.X509KeyPair(pemCert, pemKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
 }
 
 func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -146,6 +201,17 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// dialedIP extracts the IP address the proxy actually connected to, so
+// policy CIDR rules match the real peer instead of a fresh DNS lookup that
+// could answer differently than the one targetConn dialed.
+func dialedIP(conn net.Conn) net.IP {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return tcpAddr.IP
+}
+
 func (p *forwardProxy) proxyConnect(w http.ResponseWriter, req *http.Request) {
 	log.Printf("CONNECT requested to %v (from %v)", req.Host, req.RemoteAddr)
 	targetConn, err := net.Dial("tcp", req.Host)
@@ -169,65 +235,177 @@ func (p *forwardProxy) proxyConnect(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		log.Fatal("error splitting host/port:", err)
 	}
-	pemCert, pemKey := createCert([]string{host}, p.caCert, p.caKey, 240)
-	tlsCert, err := tls.X509KeyPair(pemCert, pemKey)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	if _, err := clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
 		log.Fatal("error writing status to client:", err)
 	}
 
-	//ln := &singleConnListener{conn: clientConn}
+	if p.policy != nil && !p.policy.ShouldIntercept(host, dialedIP(targetConn)) {
+		log.Println("policy bypass for", host, "- tunneling blind")
+		tunnel(clientConn, targetConn)
+		return
+	}
+
+	// We already know the target host from the CONNECT request, so the
+	// freshly-dialed targetConn is only needed for the blind tunnel case.
+	// Re-signing traffic drives all origin requests through p.transport
+	// instead, which pools connections per host.
+	targetConn.Close()
 
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
 		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
 		MinVersion:               tls.VersionTLS13,
-		Certificates:             []tls.Certificate{tlsCert},
+		// Advertise h2 so clients that speak it to the real origin don't
+		// get silently downgraded to HTTP/1.1 by the proxy.
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			sni := chi.ServerName
+			if sni == "" {
+				// Clients that skip SNI still get a usable cert for the
+				// CONNECT host.
+				sni = host
+			}
+			return p.certCache.getOrCreate(sni, p.mintCert)
+		},
 	}
-	if err != nil {
-		log.Fatal(err)
+
+	raw := tls.Server(clientConn, tlsConfig)
+	defer raw.Close()
+	if err := raw.Handshake(); err != nil {
+		log.Println("error handshake:", err)
+		return
 	}
 
-	// TODO: explicit Handshake call makes progress -- TLS handshake succeeds -- can I serve HTTP on existing connection?
+	if raw.ConnectionState().NegotiatedProtocol == "h2" {
+		p.serveH2(raw, req.Host)
+		return
+	}
 
-	//mux := http.NewServeMux()
-	//mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-	//fmt.Println("got request:", req)
-	//})
-	//srv := &http.Server{
-	//Addr:         req.Host,
-	//Handler:      mux,
-	//TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-	//}
+	p.serveTLS(raw, req.Host)
+}
 
-	//tlsListener := tls.NewListener(ln, tlsConfig)
-	//if err = srv.Serve(tlsListener); err != nil {
-	//log.Fatal(err)
-	//}
-	raw := tls.Server(clientConn, tlsConfig)
-	if err := raw.Handshake(); err != nil {
-		log.Fatal("error handshake")
+// serveTLS reads HTTP requests off the hijacked, now-decrypted client
+// connection, forwards each one to host over p.transport, and writes the
+// response back. It keeps looping until the client closes the connection or
+// either side signals it wants to stop (Connection: close, HTTP/1.0 without
+// keep-alive). WebSocket upgrade requests are handed off to
+// proxyWebSocketUpgrade, which takes the connection over entirely once the
+// origin switches protocols.
+func (p *forwardProxy) serveTLS(conn *tls.Conn, host string) {
+	clientReader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("error reading request from client:", err)
+			}
+			return
+		}
+
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+		req.RequestURI = ""
+
+		if isWebSocketUpgrade(req) {
+			if err := proxyWebSocketUpgrade(conn, clientReader, req, host); err != nil {
+				if err != io.EOF {
+					log.Println("error proxying websocket upgrade to", host, ":", err)
+				}
+				return
+			}
+			continue
+		}
+
+		var reqBody []byte
+		if req.Body != nil {
+			reqBody, _ = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		}
+
+		start := time.Now()
+		resp, err := p.transport.RoundTrip(req)
+		duration := time.Since(start)
+		if err != nil {
+			log.Println("error round-tripping request to", host, ":", err)
+			return
+		}
+
+		var respBody []byte
+		if resp.Body != nil {
+			respBody, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		}
+
+		if p.logger != nil {
+			p.logger.LogExchange(Exchange{
+				Req:        req,
+				ReqBody:    reqBody,
+				Resp:       resp,
+				RespBody:   respBody,
+				ClientAddr: conn.RemoteAddr().String(),
+				Duration:   duration,
+			})
+		}
+
+		if err := resp.Write(conn); err != nil {
+			log.Println("error writing response to client:", err)
+			return
+		}
+
+		if req.Close || resp.Close || (!req.ProtoAtLeast(1, 1) && !keepAliveRequested(req)) {
+			return
+		}
 	}
+}
 
-	_ = targetConn
-	//log.Println("tunnel established")
-	//go tunnelConn(targetConn, clientConn)
-	//go tunnelConn(clientConn, targetConn)
+// keepAliveRequested reports whether an HTTP/1.0 request explicitly asked to
+// keep the connection open via "Connection: keep-alive".
+func keepAliveRequested(req *http.Request) bool {
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "keep-alive") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func main() {
 	var addr = flag.String("addr", "127.0.0.1:9999", "proxy address")
-	caCertFile := flag.String("cacertfile", "", "certificate .pem file for trusted CA")
-	caKeyFile := flag.String("cakeyfile", "", "key .pem file for trusted CA")
+	caCertFile := flag.String("cacertfile", "ca-cert.pem", "certificate .pem file for trusted CA")
+	caKeyFile := flag.String("cakeyfile", "ca-key.pem", "key .pem file for trusted CA")
+	generateCAFlag := flag.Bool("generate-ca", false, "force generating a new root CA, overwriting cacertfile/cakeyfile if present (the default is to generate one only when they don't already exist)")
+	policyFile := flag.String("policy", "", "YAML/JSON file listing hosts to bypass interception for (defaults to a small built-in list)")
+	apiAddr := flag.String("apiaddr", "", "address to serve the /flow/ inspection API on (disabled if empty)")
 	flag.Parse()
 
-	proxy := createForwardProxy(*caCertFile, *caKeyFile)
+	proxy := createForwardProxy(*caCertFile, *caKeyFile, *generateCAFlag)
+
+	if *policyFile != "" {
+		policy, err := loadPolicy(*policyFile)
+		if err != nil {
+			log.Fatal("error loading policy file:", err)
+		}
+		proxy.policy = policy
+	}
+
+	if *apiAddr != "" {
+		router := gin.Default()
+		registerFlowRoutes(router, proxy)
+		go func() {
+			log.Println("Starting flow API server on", *apiAddr)
+			if err := router.Run(*apiAddr); err != nil {
+				log.Fatal("flow API ListenAndServe:", err)
+			}
+		}()
+	}
 
 	log.Println("Starting proxy server on", *addr)
 	if err := http.ListenAndServe(*addr, proxy); err != nil {
 		log.Fatal("ListenAndServe:", err)
 	}
-}
\ No newline at end of file
+}
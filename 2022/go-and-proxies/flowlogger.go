@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"example.com/go-and-proxies/internal/flowstore"
+)
+
+// storeLogger is a RequestLogger that persists every exchange into a
+// FlowStore so it can be inspected later through the flow API.
+type storeLogger struct {
+	store *flowstore.FlowStore
+}
+
+func (s storeLogger) LogExchange(ex Exchange) {
+	s.store.CreateFlow(flowstore.Flow{
+		Timestamp:       time.Now().Add(-ex.Duration),
+		ClientAddr:      ex.ClientAddr,
+		Method:          ex.Req.Method,
+		URL:             ex.Req.URL.String(),
+		RequestHeaders:  ex.Req.Header,
+		RequestBody:     ex.ReqBody,
+		ResponseStatus:  ex.Resp.StatusCode,
+		ResponseHeaders: ex.Resp.Header,
+		ResponseBody:    ex.RespBody,
+		Duration:        ex.Duration,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"example.com/go-and-proxies/internal/flowstore"
+	"github.com/gin-gonic/gin"
+)
+
+// flowServer exposes the flows captured by a forwardProxy over HTTP, the
+// same way taskServer exposes a taskstore.TaskStore in the gin REST example.
+type flowServer struct {
+	sync.Mutex
+	store *flowstore.FlowStore
+	proxy *forwardProxy
+}
+
+func newFlowServer(proxy *forwardProxy) *flowServer {
+	return &flowServer{store: proxy.flows, proxy: proxy}
+}
+
+func (fs *flowServer) getAllFlowsHandler(c *gin.Context) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if host := c.Query("host"); host != "" {
+		c.JSON(http.StatusOK, fs.store.GetFlowsByHost(host))
+		return
+	}
+	c.JSON(http.StatusOK, fs.store.GetAllFlows())
+}
+
+func (fs *flowServer) getFlowHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fs.Lock()
+	flow, err := fs.store.GetFlow(id)
+	fs.Unlock()
+
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, flow)
+}
+
+// replayFlowHandler re-sends a previously captured request through the
+// proxy's transport and returns the new response, without touching the
+// stored flow.
+func (fs *flowServer) replayFlowHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fs.Lock()
+	flow, err := fs.store.GetFlow(id)
+	fs.Unlock()
+
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+
+	req, err := http.NewRequest(flow.Method, flow.URL, bytes.NewReader(flow.RequestBody))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header = flow.RequestHeaders.Clone()
+
+	resp, err := fs.proxy.transport.RoundTrip(req)
+	if err != nil {
+		c.String(http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+}
+
+// registerFlowRoutes adds the /flow/ inspection API to router.
+func registerFlowRoutes(router *gin.Engine, proxy *forwardProxy) {
+	fs := newFlowServer(proxy)
+	router.GET("/flow/", fs.getAllFlowsHandler)
+	router.GET("/flow/:id", fs.getFlowHandler)
+	router.POST("/flow/:id/replay", fs.replayFlowHandler)
+}
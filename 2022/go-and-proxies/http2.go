@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// serveH2 takes over a hijacked connection that negotiated h2 via ALPN and
+// serves it with an http2.Server, round-tripping each request to host
+// through h2Transport.
+func (p *forwardProxy) serveH2(conn *tls.Conn, host string) {
+	h2s := &http2.Server{}
+	h2s.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.proxyH2Request(w, r, host)
+		}),
+	})
+}
+
+func (p *forwardProxy) proxyH2Request(w http.ResponseWriter, r *http.Request, host string) {
+	clientAddr := r.RemoteAddr
+	r.URL.Scheme = "https"
+	r.URL.Host = host
+	r.RequestURI = ""
+
+	var reqBody []byte
+	if r.Body != nil {
+		reqBody, _ = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	start := time.Now()
+	resp, err := p.h2Transport.RoundTrip(r)
+	duration := time.Since(start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if p.logger != nil {
+		p.logger.LogExchange(Exchange{
+			Req:        r,
+			ReqBody:    reqBody,
+			Resp:       resp,
+			RespBody:   respBody,
+			ClientAddr: clientAddr,
+			Duration:   duration,
+		})
+	}
+
+	for name, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
@@ -0,0 +1,112 @@
+// Package flowstore provides an in-memory store of captured MITM proxy
+// flows, mirroring the shape of the taskstore package used elsewhere in
+// this project.
+package flowstore
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Flow is one intercepted request/response exchange.
+type Flow struct {
+	Id         int       `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	ClientAddr string    `json:"clientAddr"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	RequestBody     []byte      `json:"requestBody"`
+	ResponseStatus  int         `json:"responseStatus"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	ResponseBody    []byte      `json:"responseBody"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// FlowStore is a concurrency-safe, in-memory collection of Flows, keyed by
+// an ever-increasing id.
+type FlowStore struct {
+	sync.Mutex
+
+	flows  map[int]Flow
+	nextId int
+}
+
+func New() *FlowStore {
+	fs := &FlowStore{}
+	fs.flows = make(map[int]Flow)
+	fs.nextId = 1
+	return fs
+}
+
+// CreateFlow records a new flow and returns its assigned id.
+func (fs *FlowStore) CreateFlow(f Flow) int {
+	fs.Lock()
+	defer fs.Unlock()
+
+	f.Id = fs.nextId
+	fs.flows[f.Id] = f
+	fs.nextId++
+	return f.Id
+}
+
+func (fs *FlowStore) GetAllFlows() []Flow {
+	fs.Lock()
+	defer fs.Unlock()
+
+	allFlows := make([]Flow, 0, len(fs.flows))
+	for _, f := range fs.flows {
+		allFlows = append(allFlows, f)
+	}
+	return allFlows
+}
+
+func (fs *FlowStore) GetFlow(id int) (Flow, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	f, ok := fs.flows[id]
+	if !ok {
+		return Flow{}, fmt.Errorf("flow with id=%d not found", id)
+	}
+	return f, nil
+}
+
+// GetFlowsByHost returns every flow whose URL hostname, with any port
+// stripped, equals host exactly.
+func (fs *FlowStore) GetFlowsByHost(host string) []Flow {
+	fs.Lock()
+	defer fs.Unlock()
+
+	flows := make([]Flow, 0)
+	for _, f := range fs.flows {
+		if flowHost(f) == host {
+			flows = append(flows, f)
+		}
+	}
+	return flows
+}
+
+func (fs *FlowStore) DeleteFlow(id int) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if _, ok := fs.flows[id]; !ok {
+		return fmt.Errorf("flow with id=%d not found", id)
+	}
+	delete(fs.flows, id)
+	return nil
+}
+
+func flowHost(f Flow) string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy decides whether a CONNECT target should be intercepted (MITM'd) or
+// left alone. Hosts that fail ShouldIntercept are spliced through as a
+// classic, blind HTTPS tunnel instead. ip is the address the proxy actually
+// dialed for host, so CIDR rules match the real peer rather than a fresh,
+// possibly different DNS answer.
+type Policy interface {
+	ShouldIntercept(host string, ip net.IP) bool
+}
+
+// defaultBypassHosts ships as a conservative starting point: certificate
+// pinning on these is common enough that re-signing them just breaks the
+// client rather than revealing anything.
+var defaultBypassHosts = []string{
+	"*.apple.com",
+	"*.googleapis.com",
+}
+
+// rulePolicy bypasses interception for any host matching one of its glob
+// patterns, regexes, or CIDRs (matched against the IP the proxy actually
+// dialed for that host). Everything else is intercepted.
+type rulePolicy struct {
+	globs   []string
+	regexes []*regexp.Regexp
+	cidrs   []*net.IPNet
+}
+
+func newDefaultPolicy() *rulePolicy {
+	return &rulePolicy{globs: defaultBypassHosts}
+}
+
+func (p *rulePolicy) ShouldIntercept(host string, ip net.IP) bool {
+	return !p.bypassed(host, ip)
+}
+
+func (p *rulePolicy) bypassed(host string, ip net.IP) bool {
+	for _, g := range p.globs {
+		if ok, _ := filepath.Match(g, host); ok {
+			return true
+		}
+	}
+	for _, re := range p.regexes {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	if ip != nil {
+		for _, cidr := range p.cidrs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// policyConfig is the on-disk shape accepted by -policy, as either YAML or
+// JSON depending on the file extension.
+type policyConfig struct {
+	BypassGlobs   []string `json:"bypassGlobs" yaml:"bypassGlobs"`
+	BypassRegexes []string `json:"bypassRegexes" yaml:"bypassRegexes"`
+	BypassCIDRs   []string `json:"bypassCIDRs" yaml:"bypassCIDRs"`
+}
+
+// loadPolicy reads a rules file and builds the Policy it describes. YAML is
+// used for .yaml/.yml paths, JSON otherwise.
+func loadPolicy(path string) (Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg policyConfig
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &cfg)
+	} else {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &rulePolicy{globs: cfg.BypassGlobs}
+	for _, pattern := range cfg.BypassRegexes {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rp.regexes = append(rp.regexes, re)
+	}
+	for _, cidrStr := range cfg.BypassCIDRs {
+		_, cidr, err := net.ParseCIDR(cidrStr)
+		if err != nil {
+			return nil, err
+		}
+		rp.cidrs = append(rp.cidrs, cidr)
+	}
+	return rp, nil
+}
+
+// tunnel splices client and target together unmodified, for CONNECT
+// targets the policy says not to intercept. Both ends are closed as soon as
+// either copy direction returns, so a peer that goes idle on one side
+// (common when a client navigates away while the origin keeps the
+// connection open) doesn't leak the pair of sockets forever.
+func tunnel(client, target net.Conn) {
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(target, client)
+	go cp(client, target)
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Exchange bundles a captured request/response pair with the metadata
+// RequestLoggers need but that doesn't live on either http.Request or
+// http.Response - which client dialed in, and how long the origin took.
+type Exchange struct {
+	Req        *http.Request
+	ReqBody    []byte
+	Resp       *http.Response
+	RespBody   []byte
+	ClientAddr string
+	Duration   time.Duration
+}
+
+// RequestLogger is notified about every request/response pair that passes
+// through the MITM tunnel. Implementations must be safe for concurrent use,
+// since proxyConnect may be driving several tunnels at once.
+type RequestLogger interface {
+	LogExchange(ex Exchange)
+}
+
+// multiLogger fans an Exchange out to several RequestLoggers.
+type multiLogger []RequestLogger
+
+func (m multiLogger) LogExchange(ex Exchange) {
+	for _, l := range m {
+		l.LogExchange(ex)
+	}
+}
+
+// dumpLogger is the default RequestLogger. It prints method, URL and headers
+// for both sides of the exchange, and additionally decodes
+// application/x-www-form-urlencoded bodies so form posts are readable.
+type dumpLogger struct{}
+
+func (dumpLogger) LogExchange(ex Exchange) {
+	req, resp := ex.Req, ex.Resp
+	log.Printf("--> %s %s", req.Method, req.URL)
+	dumpHeaders(req.Header)
+	dumpFormBody(req.Header.Get("Content-Type"), ex.ReqBody)
+
+	log.Printf("<-- %s %s (%s)", resp.Status, req.URL, ex.Duration)
+	dumpHeaders(resp.Header)
+	dumpFormBody(resp.Header.Get("Content-Type"), ex.RespBody)
+}
+
+func dumpHeaders(h http.Header) {
+	for name, values := range h {
+		for _, v := range values {
+			log.Printf("    %s: %s", name, v)
+		}
+	}
+}
+
+func dumpFormBody(contentType string, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/x-www-form-urlencoded" {
+		return
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return
+	}
+	for name, vs := range values {
+		for _, v := range vs {
+			log.Printf("    form %s = %s", name, v)
+		}
+	}
+}
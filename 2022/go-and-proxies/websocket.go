@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// isWebSocketUpgrade reports whether req is asking to switch the connection
+// to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+// proxyWebSocketUpgrade forwards a WebSocket handshake request to hostport
+// over a fresh TLS connection. If the origin answers with 101 Switching
+// Protocols, it relays that response to the client and then splices the two
+// connections byte-for-byte, returning only once the WebSocket session
+// ends. Otherwise it relays whatever response the origin did send and
+// returns, leaving the caller's HTTP/1.1 loop free to keep going.
+func proxyWebSocketUpgrade(clientConn *tls.Conn, clientReader *bufio.Reader, req *http.Request, hostport string) error {
+	targetConn, err := tls.Dial("tcp", hostport, &tls.Config{NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		return err
+	}
+	defer targetConn.Close()
+
+	if err := req.Write(targetConn); err != nil {
+		return err
+	}
+
+	targetReader := bufio.NewReader(targetConn)
+	resp, err := http.ReadResponse(targetReader, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := resp.Write(clientConn); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Origin declined the upgrade; the response above was the whole
+		// exchange, so the caller's request loop can keep reading.
+		return nil
+	}
+
+	log.Println("websocket upgrade established with", hostport)
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(targetConn, clientReader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, targetReader)
+		errc <- err
+	}()
+	<-errc
+
+	// The connection is now raw WebSocket bytes; io.EOF tells the caller's
+	// HTTP loop to stop without logging it as a read error.
+	return io.EOF
+}